@@ -0,0 +1,164 @@
+package emsort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// blockTargetSize is the amount of uncompressed data accumulated before a
+// block is compressed and flushed to disk.
+const blockTargetSize = 64 * 1024
+
+// blockHeaderSize is the size, in bytes, of the fixed header written before
+// each block's payload: the uncompressed length, the compressed length and
+// a CRC32C checksum of the compressed payload, each a big-endian uint32.
+const blockHeaderSize = 12
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockWriter buffers raw bytes and periodically compresses and frames them
+// as blocks written to an underlying io.Writer.
+type blockWriter struct {
+	w           io.Writer
+	compression Compression
+	buf         []byte
+	compressed  []byte
+	header      [blockHeaderSize]byte
+	written     int
+}
+
+func newBlockWriter(w io.Writer, compression Compression) *blockWriter {
+	return &blockWriter{w: w, compression: compression}
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	bw.buf = append(bw.buf, p...)
+	for len(bw.buf) >= blockTargetSize {
+		if err := bw.flushBlock(blockTargetSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush emits any buffered bytes as a final, possibly undersized, block.
+func (bw *blockWriter) Flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	return bw.flushBlock(len(bw.buf))
+}
+
+func (bw *blockWriter) flushBlock(n int) error {
+	block := bw.buf[:n]
+	bw.compressed = bw.compression.Compress(bw.compressed[:0], block)
+
+	binary.BigEndian.PutUint32(bw.header[0:4], uint32(len(block)))
+	binary.BigEndian.PutUint32(bw.header[4:8], uint32(len(bw.compressed)))
+	binary.BigEndian.PutUint32(bw.header[8:12], crc32.Checksum(bw.compressed, crc32cTable))
+
+	if _, err := bw.w.Write(bw.header[:]); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(bw.compressed); err != nil {
+		return err
+	}
+	bw.written += blockHeaderSize + len(bw.compressed)
+
+	remaining := copy(bw.buf, bw.buf[n:])
+	bw.buf = bw.buf[:remaining]
+	return nil
+}
+
+// writeRunHeader writes name, the Name of the Comparer a run was sorted
+// with, before that run's blocks, so that a reader which compares the name
+// returned by readRunHeader against its own Comparer catches a mismatch
+// instead of silently merging runs in an undefined order. It returns the
+// number of bytes written.
+func writeRunHeader(w io.Writer, name string) (int, error) {
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(sizeBuf, uint64(len(name)))
+	if _, err := w.Write(sizeBuf[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, name); err != nil {
+		return 0, err
+	}
+	return n + len(name), nil
+}
+
+// readRunHeader reads the Comparer name written by writeRunHeader. r must
+// be the same *bufio.Reader later used to read the run's blocks, so that
+// bytes buffered while parsing the header aren't lost.
+func readRunHeader(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// blockReader reads blocks framed by blockWriter and presents their
+// decompressed contents as a single byte stream.
+type blockReader struct {
+	r           io.Reader
+	compression Compression
+	header      [blockHeaderSize]byte
+	compressed  []byte
+	buf         []byte
+	pos         int
+}
+
+func newBlockReader(r io.Reader, compression Compression) *blockReader {
+	return &blockReader{r: r, compression: compression}
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if br.pos == len(br.buf) {
+		if err := br.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.buf[br.pos:])
+	br.pos += n
+	return n, nil
+}
+
+func (br *blockReader) fill() error {
+	if _, err := io.ReadFull(br.r, br.header[:]); err != nil {
+		return err
+	}
+	uncompressedLen := binary.BigEndian.Uint32(br.header[0:4])
+	compressedLen := binary.BigEndian.Uint32(br.header[4:8])
+	wantCRC := binary.BigEndian.Uint32(br.header[8:12])
+
+	if cap(br.compressed) < int(compressedLen) {
+		br.compressed = make([]byte, compressedLen)
+	}
+	br.compressed = br.compressed[:compressedLen]
+	if _, err := io.ReadFull(br.r, br.compressed); err != nil {
+		return err
+	}
+
+	if gotCRC := crc32.Checksum(br.compressed, crc32cTable); gotCRC != wantCRC {
+		return fmt.Errorf("emsort: corrupt run, block checksum mismatch")
+	}
+
+	buf, err := br.compression.Decompress(br.buf[:0], br.compressed)
+	if err != nil {
+		return err
+	}
+	if uint32(len(buf)) != uncompressedLen {
+		return fmt.Errorf("emsort: corrupt run, block length mismatch")
+	}
+	br.buf = buf
+	br.pos = 0
+	return nil
+}
@@ -0,0 +1,30 @@
+package emsort
+
+import "bytes"
+
+// Comparer defines a total order over the keys passed to an ExternalSorter.
+// It is modeled on goleveldb's comparer.Comparer so that keys already
+// ordered for a LevelDB instance can be reused verbatim.
+type Comparer interface {
+	// Compare returns -1 if a < b, 0 if a == b and +1 if a > b, using
+	// whatever ordering the implementation defines.
+	Compare(a, b []byte) int
+
+	// Name returns the name of the comparer. This is used to make sure
+	// runs produced with one comparer are never merged with runs from a
+	// different comparer.
+	Name() string
+}
+
+// BytesComparer is the default Comparer, ordering keys lexicographically by
+// their raw bytes via bytes.Compare. This preserves emsort's original
+// behavior.
+type BytesComparer struct{}
+
+func (BytesComparer) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (BytesComparer) Name() string {
+	return "emsort.BytesComparer"
+}
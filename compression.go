@@ -0,0 +1,53 @@
+package emsort
+
+import "github.com/golang/snappy"
+
+// Compression compresses and decompresses the contents of a single on-disk
+// block. Compress and Decompress follow Go's append-style buffer-reuse
+// convention: callers typically pass dst[:0] from a buffer they intend to
+// reuse across many blocks, and must use the returned slice rather than
+// assume dst was mutated in place. Each implementation is responsible for
+// actually using dst's spare capacity where it can: unlike append,
+// snappy.Encode/snappy.Decode only reuse a dst whose length, not merely its
+// capacity, already covers the output, so snappyCompression grows dst to
+// that length itself before delegating to them.
+type Compression interface {
+	Compress(dst, src []byte) []byte
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// NoCompression stores blocks verbatim. It is the default.
+var NoCompression Compression = noCompression{}
+
+// SnappyCompression compresses blocks with Snappy, a good default given how
+// well it fits sorted, low-entropy key data such as hashes or log lines.
+var SnappyCompression Compression = snappyCompression{}
+
+type noCompression struct{}
+
+func (noCompression) Compress(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noCompression) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type snappyCompression struct{}
+
+func (snappyCompression) Compress(dst, src []byte) []byte {
+	// snappy.Encode reallocates unless len(dst) already covers the worst
+	// case, so extend dst to that length ourselves whenever its spare
+	// capacity allows it, rather than always handing it dst[:0].
+	if n := snappy.MaxEncodedLen(len(src)); n >= 0 && cap(dst) >= n {
+		dst = dst[:n]
+	}
+	return snappy.Encode(dst, src)
+}
+
+func (snappyCompression) Decompress(dst, src []byte) ([]byte, error) {
+	if n, err := snappy.DecodedLen(src); err == nil && cap(dst) >= n {
+		dst = dst[:n]
+	}
+	return snappy.Decode(dst, src)
+}
@@ -7,12 +7,11 @@ package emsort
 
 import (
 	"bufio"
-	"bytes"
 	"container/heap"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"sort"
+	"sync"
 )
 
 const writeBufferSize = 16 * 1024 * 1024
@@ -22,80 +21,116 @@ type File interface {
 	io.ReaderAt
 }
 
-func New(memLimit int, tmpfile File) (*ExternalSorter, error) {
+// Options configures an ExternalSorter.
+type Options struct {
+	// Comparer defines the ordering used to sort and merge records. If nil,
+	// BytesComparer is used, preserving lexicographic bytes.Compare order.
+	Comparer Comparer
+
+	// Compression compresses the blocks each run is written in. If nil,
+	// NoCompression is used.
+	Compression Compression
+
+	// RecordSize is the size, in bytes, of each record for Merge and
+	// NewMergeIterator, mirroring the recordSize passed to NewFixedSize. It
+	// is ignored by New/NewFixedSize, which take their record size
+	// directly. Zero means records are varint-length-prefixed.
+	RecordSize int
+
+	// Unique drops records that compare equal, per Comparer, to one
+	// already returned, keeping only the first. Ignored if MergeFunc is
+	// set, since MergeFunc already implies uniquing.
+	Unique bool
+
+	// MergeFunc, if set, combines records that compare equal per Comparer
+	// into one record, e.g. to sum counts. It is called once per extra
+	// equal-keyed record, as MergeFunc(result, next), folding left to right
+	// in heap-pop order. Neither the in-memory sort nor the merge is stable,
+	// so that order is not the order in which the records were pushed.
+	MergeFunc func(a, b []byte) []byte
+}
+
+func (o Options) comparer() Comparer {
+	if o.Comparer != nil {
+		return o.Comparer
+	}
+	return BytesComparer{}
+}
+
+func (o Options) compression() Compression {
+	if o.Compression != nil {
+		return o.Compression
+	}
+	return NoCompression
+}
+
+func New(memLimit int, tmpfile File, opts Options) (*ExternalSorter, error) {
 	return &ExternalSorter{
-		tmpfile:  tmpfile,
-		memLimit: memLimit,
+		tmpfile:     tmpfile,
+		memLimit:    memLimit,
+		cmp:         opts.comparer(),
+		compression: opts.compression(),
+		unique:      opts.Unique,
+		mergeFunc:   opts.MergeFunc,
 	}, nil
 }
 
-func NewFixedSize(recordSize, memLimit int, tmpfile File) (*ExternalSorter, error) {
+func NewFixedSize(recordSize, memLimit int, tmpfile File, opts Options) (*ExternalSorter, error) {
 	return &ExternalSorter{
-		tmpfile:    tmpfile,
-		recordSize: recordSize,
-		memLimit:   memLimit,
+		tmpfile:     tmpfile,
+		recordSize:  recordSize,
+		memLimit:    memLimit,
+		cmp:         opts.comparer(),
+		compression: opts.compression(),
+		unique:      opts.Unique,
+		mergeFunc:   opts.MergeFunc,
 	}, nil
 }
 
 type ExternalSorter struct {
-	tmpfile    File
-	recordSize int
-	memLimit   int
-	memUsed    int
-	sizes      []int
-	vals       [][]byte
+	tmpfile     File
+	recordSize  int
+	memLimit    int
+	memUsed     int
+	sizes       []int
+	vals        [][]byte
+	cmp         Comparer
+	compression Compression
+	unique      bool
+	mergeFunc   func(a, b []byte) []byte
+
+	// Writing. flushWG tracks the single in-flight background flush, if
+	// any, started by rotate; flushErr is its result, readable once
+	// flushWG.Wait returns.
+	flushWG  sync.WaitGroup
+	flushErr error
 
 	// Reading.
 	entries *entryHeap
 }
 
+// Push appends b to the sorter. Once the active buffer reaches memLimit, it
+// is handed off to a background goroutine to be sorted and flushed to disk
+// while Push keeps filling a fresh buffer; see rotate.
 func (s *ExternalSorter) Push(b []byte) error {
 	s.vals = append(s.vals, b)
 	s.memUsed += len(b)
 	if s.memUsed >= s.memLimit {
-		if err := s.flush(); err != nil {
-			return err
-		}
+		return s.rotate()
 	}
 	return nil
 }
 
-func (s *ExternalSorter) flush() error {
-	sort.Sort(&inmemory{s.vals})
-
-	out := bufio.NewWriterSize(s.tmpfile, writeBufferSize)
-	sizeBuf := make([]byte, binary.MaxVarintLen64)
-	size := 0
-	for _, val := range s.vals {
-		if s.recordSize == 0 {
-			n := binary.PutUvarint(sizeBuf, uint64(len(val)))
-			if _, err := out.Write(sizeBuf[:n]); err != nil {
-				return err
-			}
-			size += n
-		}
-		if _, err := out.Write(val); err != nil {
-			return err
-		}
-		size += len(val)
-	}
-	if err := out.Flush(); err != nil {
-		return err
-	}
-
-	s.sizes = append(s.sizes, size)
-	s.vals = s.vals[:0]
-	s.memUsed = 0
-
-	return nil
-}
-
 func (s *ExternalSorter) StopWriting() error {
 	if s.memUsed > 0 {
-		if err := s.flush(); err != nil {
+		if err := s.rotate(); err != nil {
 			return err
 		}
 	}
+	s.flushWG.Wait()
+	if s.flushErr != nil {
+		return s.flushErr
+	}
 
 	// Free memory used by last read vals
 	s.vals = nil
@@ -105,11 +140,25 @@ func (s *ExternalSorter) StopWriting() error {
 	for i, size := range s.sizes {
 		file := io.NewSectionReader(s.tmpfile, int64(total), int64(size))
 		total += size
-		files[i] = bufio.NewReaderSize(file, s.memLimit/len(s.sizes))
+
+		header := bufio.NewReader(file)
+		name, err := readRunHeader(header)
+		if err != nil {
+			return err
+		}
+		if name != s.cmp.Name() {
+			return fmt.Errorf("emsort: run %d was written with comparer %q, but StopWriting was called with comparer %q", i, name, s.cmp.Name())
+		}
+
+		block := newBlockReader(header, s.compression)
+		files[i] = bufio.NewReaderSize(block, s.memLimit/len(s.sizes))
 	}
 
 	s.entries = &entryHeap{
-		entries: make([]*entry, len(files)),
+		cmp:       s.cmp,
+		unique:    s.unique,
+		mergeFunc: s.mergeFunc,
+		entries:   make([]*entry, len(files)),
 	}
 	for i, file := range files {
 		e := &entry{
@@ -130,27 +179,15 @@ func (s *ExternalSorter) StopWriting() error {
 	return nil
 }
 
-func (s *ExternalSorter) Pop() (result []byte, err error) {
-	if s.entries.Len() == 0 {
-		return nil, io.EOF
-	}
-
-	e := heap.Pop(s.entries).(*entry)
-	result = e.val
-
-	has, err := e.Read()
-	if err != nil {
-		return nil, err
-	}
-	if has {
-		heap.Push(s.entries, e)
-	}
-
-	return
+func (s *ExternalSorter) Pop() ([]byte, error) {
+	return s.entries.popMerged()
 }
 
+var _ Sorter = (*ExternalSorter)(nil)
+
 type inmemory struct {
 	vals [][]byte
+	cmp  Comparer
 }
 
 func (im *inmemory) Len() int {
@@ -158,7 +195,7 @@ func (im *inmemory) Len() int {
 }
 
 func (im *inmemory) Less(i, j int) bool {
-	return bytes.Compare(im.vals[i], im.vals[j]) == -1
+	return im.cmp.Compare(im.vals[i], im.vals[j]) == -1
 }
 
 func (im *inmemory) Swap(i, j int) {
@@ -195,7 +232,52 @@ func (e *entry) Read() (bool, error) {
 }
 
 type entryHeap struct {
-	entries []*entry
+	cmp       Comparer
+	unique    bool
+	mergeFunc func(a, b []byte) []byte
+	entries   []*entry
+}
+
+// popMerged pops the minimum entry, advancing it and any other entries
+// whose value compares equal to it per cmp, folding the extras into the
+// result via mergeFunc (or simply dropping them if unique is set but
+// mergeFunc is nil). With neither unique nor mergeFunc set, this is
+// equivalent to a plain heap pop.
+func (eh *entryHeap) popMerged() ([]byte, error) {
+	if eh.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	e := heap.Pop(eh).(*entry)
+	key := e.val
+	result := e.val
+
+	has, err := e.Read()
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		heap.Push(eh, e)
+	}
+
+	if eh.unique || eh.mergeFunc != nil {
+		for eh.Len() > 0 && eh.cmp.Compare(eh.entries[0].val, key) == 0 {
+			dup := heap.Pop(eh).(*entry)
+			if eh.mergeFunc != nil {
+				result = eh.mergeFunc(result, dup.val)
+			}
+
+			has, err := dup.Read()
+			if err != nil {
+				return nil, err
+			}
+			if has {
+				heap.Push(eh, dup)
+			}
+		}
+	}
+
+	return result, nil
 }
 
 func (eh *entryHeap) Len() int {
@@ -203,7 +285,7 @@ func (eh *entryHeap) Len() int {
 }
 
 func (eh *entryHeap) Less(i, j int) bool {
-	return bytes.Compare(eh.entries[i].val, eh.entries[j].val) == -1
+	return eh.cmp.Compare(eh.entries[i].val, eh.entries[j].val) == -1
 }
 
 func (eh *entryHeap) Swap(i, j int) {
@@ -1,25 +1,19 @@
 package emsort
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"testing"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
 )
 
-type sorter interface {
-	Push(b []byte) error
-	StopWriting() error
-	Pop() ([]byte, error)
-}
-
-func checkHashes(t *testing.T, s sorter) {
+func checkHashes(t *testing.T, s Sorter) {
 	// Calculate sha256 of concatentation of sorted array of sha256's of "0", "1", ..., "4999999".
 
 	t.Parallel()
@@ -66,7 +60,7 @@ func TestHashSorting(t *testing.T) {
 	}
 	defer os.Remove(tmpfile.Name())
 
-	s, err := New(50*1024*1024, tmpfile)
+	s, err := New(50*1024*1024, tmpfile, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,7 +75,7 @@ func TestHashSortingFixed(t *testing.T) {
 	}
 	defer os.Remove(tmpfile.Name())
 
-	s, err := NewFixedSize(sha256.Size, 50*1024*1024, tmpfile)
+	s, err := NewFixedSize(sha256.Size, 50*1024*1024, tmpfile, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -89,46 +83,412 @@ func TestHashSortingFixed(t *testing.T) {
 	checkHashes(t, s)
 }
 
-func TestHashSortingLevel(t *testing.T) {
-	dir, err := ioutil.TempDir("", "emsort-level")
+func TestHashSortingSnappy(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "emsort")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(dir)
+	defer os.Remove(tmpfile.Name())
 
-	db, err := leveldb.OpenFile(dir, nil)
+	s, err := New(50*1024*1024, tmpfile, Options{Compression: SnappyCompression})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
-
-	s := &leveldbSorter{db: db}
-	defer func() {
-		s.iter.Release()
-	}()
 
 	checkHashes(t, s)
 }
 
-type leveldbSorter struct {
-	db   *leveldb.DB
-	iter iterator.Iterator
+// TestSnappyCompressionReuse checks that SnappyCompression actually reuses
+// a dst with enough spare capacity instead of always reallocating, which
+// snappy.Encode only does when len(dst), not cap(dst), already covers the
+// worst case.
+func TestSnappyCompressionReuse(t *testing.T) {
+	src := bytes.Repeat([]byte("hello world"), 100)
+
+	out1 := SnappyCompression.Compress(nil, src)
+	out2 := SnappyCompression.Compress(out1[:0], src)
+
+	if &out1[:cap(out1)][0] != &out2[:cap(out2)][0] {
+		t.Fatal("expected Compress to reuse dst's backing array when it already has enough capacity")
+	}
 }
 
-var value = []byte("")
+func TestIterator(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "emsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	s, err := New(1024, tmpfile, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []string{"5", "3", "1", "4", "2", "9", "7", "6", "8", "0"} {
+		if err := s.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := s.NewIterator()
+	defer it.Release()
+
+	if !it.Seek([]byte("3")) {
+		t.Fatal("expected Seek to find a record")
+	}
+	var got []string
+	for ; it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
 
-func (s *leveldbSorter) Push(b []byte) error {
-	return s.db.Put(b, value, nil)
+	want := []string{"3", "4", "5", "6", "7", "8", "9"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
 }
 
-func (s *leveldbSorter) StopWriting() error {
-	s.iter = s.db.NewIterator(nil, nil)
-	return nil
+// TestIteratorFirstNoRewind checks that calling First a second time fails
+// instead of silently restarting the stream, since mergeIterator can't
+// actually rewind the per-run readers it already advanced.
+func TestIteratorFirstNoRewind(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "emsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	s, err := New(1024, tmpfile, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []string{"1", "2", "3"} {
+		if err := s.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := s.NewIterator()
+	defer it.Release()
+
+	if !it.First() {
+		t.Fatal("expected First to find a record")
+	}
+	if !it.Next() {
+		t.Fatal("expected Next to find a record")
+	}
+	if it.First() {
+		t.Fatal("expected a second First to fail rather than rewind")
+	}
+	if it.Error() == nil {
+		t.Fatal("expected Error to be set after a second First")
+	}
+}
+
+func buildRun(t *testing.T, vals []string) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if _, err := writeRunHeader(buf, BytesComparer{}.Name()); err != nil {
+		t.Fatal(err)
+	}
+	block := newBlockWriter(buf, NoCompression)
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+	for _, val := range vals {
+		n := binary.PutUvarint(sizeBuf, uint64(len(val)))
+		if _, err := block.Write(sizeBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := block.Write([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := block.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
 }
 
-func (s *leveldbSorter) Pop() ([]byte, error) {
-	if !s.iter.Next() {
-		return nil, io.EOF
+func TestMerge(t *testing.T) {
+	run1 := buildRun(t, []string{"1", "3", "5", "7", "9"})
+	run2 := buildRun(t, []string{"0", "2", "4", "6", "8"})
+
+	out := &bytes.Buffer{}
+	if err := Merge([]io.Reader{run1, run2}, out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := NewMergeIterator([]io.Reader{out}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Release()
+
+	var got []string
+	for it.First(); it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// TestBlockCorruption checks that flipping a byte in a written block is
+// caught by blockReader's CRC32C check rather than silently returning
+// corrupt data.
+func TestBlockCorruption(t *testing.T) {
+	run := buildRun(t, []string{"1", "2", "3"})
+	data := run.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	header := bufio.NewReader(bytes.NewReader(data))
+	if _, err := readRunHeader(header); err != nil {
+		t.Fatal(err)
+	}
+
+	block := newBlockReader(header, NoCompression)
+	_, err := block.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("expected a corrupt run error, got nil")
+	}
+	if got, want := err.Error(), "emsort: corrupt run, block checksum mismatch"; got != want {
+		t.Fatalf("got error %q, want %q", got, want)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "emsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	s, err := New(1024, tmpfile, Options{Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []string{"1", "2", "2", "1", "3", "2"} {
+		if err := s.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		record, err := s.Pop()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(record))
+	}
+
+	want := []string{"1", "2", "3"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// keyComparer orders "key=count" records by the part before "=", so that
+// records sharing a key are treated as equal regardless of their count.
+type keyComparer struct{}
+
+func (keyComparer) Compare(a, b []byte) int {
+	return bytes.Compare(keyOf(a), keyOf(b))
+}
+
+func (keyComparer) Name() string {
+	return "test.keyComparer"
+}
+
+func keyOf(record []byte) []byte {
+	return record[:bytes.IndexByte(record, '=')]
+}
+
+func TestMergeFunc(t *testing.T) {
+	sum := func(a, b []byte) []byte {
+		an, _ := strconv.Atoi(string(a[bytes.IndexByte(a, '=')+1:]))
+		bn, _ := strconv.Atoi(string(b[bytes.IndexByte(b, '=')+1:]))
+		return []byte(string(keyOf(a)) + "=" + strconv.Itoa(an+bn))
+	}
+
+	tmpfile, err := ioutil.TempFile("", "emsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	s, err := New(1024, tmpfile, Options{Comparer: keyComparer{}, MergeFunc: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []string{"b=2", "a=1", "a=3"} {
+		if err := s.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		record, err := s.Pop()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(record))
+	}
+
+	want := []string{"a=4", "b=2"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "emsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	vals := []string{"5", "3", "1", "4", "2"}
+	i := 0
+	next := func() ([]byte, error) {
+		if i == len(vals) {
+			return nil, io.EOF
+		}
+		val := vals[i]
+		i++
+		return []byte(val), nil
+	}
+
+	var got []string
+	emit := func(b []byte) error {
+		got = append(got, string(b))
+		return nil
+	}
+
+	opts := SortOptions{MemLimit: 1024}
+	if err := Sort(tmpfile, opts, next, emit); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"1", "2", "3", "4", "5"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// TestSortBackend checks that Sort picks SortOptions.Backend over
+// ExternalSorter when ExpectedSize fits within MemLimit, and falls back to
+// ExternalSorter otherwise.
+func TestSortBackend(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		expectedSize int
+		wantBackend  bool
+	}{
+		{"fits", 10, true},
+		{"tooBig", 10 * 1024, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmpfile, err := ioutil.TempFile("", "emsort")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			var backendUsed bool
+			backend := func(opts Options) (Sorter, error) {
+				backendUsed = true
+				return New(1024, tmpfile, opts)
+			}
+
+			vals := []string{"5", "3", "1", "4", "2"}
+			i := 0
+			next := func() ([]byte, error) {
+				if i == len(vals) {
+					return nil, io.EOF
+				}
+				val := vals[i]
+				i++
+				return []byte(val), nil
+			}
+
+			var got []string
+			emit := func(b []byte) error {
+				got = append(got, string(b))
+				return nil
+			}
+
+			opts := SortOptions{MemLimit: 1024, ExpectedSize: test.expectedSize, Backend: backend}
+			if err := Sort(tmpfile, opts, next, emit); err != nil {
+				t.Fatal(err)
+			}
+
+			if backendUsed != test.wantBackend {
+				t.Fatalf("backend used = %v, want %v", backendUsed, test.wantBackend)
+			}
+
+			want := []string{"1", "2", "3", "4", "5"}
+			if len(got) != len(want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+			}
+		})
 	}
-	return s.iter.Key(), nil
 }
@@ -0,0 +1,143 @@
+package emsort
+
+import (
+	"errors"
+	"io"
+)
+
+// errNoRewind is returned by mergeIterator.First when First, Next or Seek
+// has already been called; see its doc comment on Iterator.First.
+var errNoRewind = errors.New("emsort: Iterator.First called again after the stream has advanced; this Iterator cannot rewind")
+
+// Iterator provides read-only, seekable access to a sorted stream of
+// records, modeled on goleveldb's iterator.Iterator. Unlike that interface,
+// an Iterator backed by an ExternalSorter or Merge is forward-only: the
+// underlying runs are each read once, in order, so there is no Prev or
+// Last, and First only positions the iterator the first time it is
+// called; calling it again after any Next or Seek fails rather than
+// silently re-reading from the start. Backends that read from a
+// structure supporting real random access, such as emsort/leveldbbackend,
+// may honor repeated First calls as a true rewind instead. It is
+// implemented by mergeIterator here, and by backends such as
+// emsort/leveldbbackend.
+type Iterator interface {
+	// First positions the iterator at the first record, the same as the
+	// first Next would. It returns false if the underlying stream is
+	// empty, if it was already advanced past the first record, or if an
+	// error was encountered; check Error to tell the first case from the
+	// other two.
+	First() bool
+
+	// Next advances the iterator to the next record. It returns false once
+	// the stream is exhausted or an error was encountered; check Error in
+	// that case.
+	Next() bool
+
+	// Seek advances the iterator to the first record whose key is greater
+	// than or equal to target.
+	Seek(target []byte) bool
+
+	// Key returns the current record. The returned slice is only valid
+	// until the next call to First, Next or Seek.
+	Key() []byte
+
+	// Valid returns whether the iterator is positioned at a record.
+	Valid() bool
+
+	// Error returns any error encountered while reading the underlying
+	// stream.
+	Error() error
+
+	// Release frees resources held by the iterator. The iterator must not
+	// be used afterwards.
+	Release()
+}
+
+// mergeIterator is the Iterator returned by ExternalSorter.NewIterator and
+// NewMergeIterator; it walks an entryHeap the same way Pop does.
+type mergeIterator struct {
+	cmp     Comparer
+	entries *entryHeap
+	key     []byte
+	err     error
+	started bool
+}
+
+// NewIterator returns an Iterator over the merged, sorted output of s. It
+// must be called after StopWriting. The returned Iterator takes ownership
+// of the per-run readers backing s; Pop must not be called afterwards.
+func (s *ExternalSorter) NewIterator() Iterator {
+	it := &mergeIterator{cmp: s.cmp, entries: s.entries}
+	s.entries = nil
+	return it
+}
+
+func (it *mergeIterator) First() bool {
+	if it.started {
+		it.err = errNoRewind
+		it.key = nil
+		return false
+	}
+	it.started = true
+	return it.advance()
+}
+
+func (it *mergeIterator) Next() bool {
+	return it.advance()
+}
+
+// Seek does a k-way advance across the per-run readers, so it is no
+// cheaper than repeated calls to Next, but it lets callers skip records
+// they don't care about without buffering them.
+func (it *mergeIterator) Seek(target []byte) bool {
+	if it.key == nil && it.err == nil {
+		if !it.advance() {
+			return false
+		}
+	}
+	for it.Valid() && it.cmp.Compare(it.key, target) < 0 {
+		if !it.advance() {
+			return false
+		}
+	}
+	return it.Valid()
+}
+
+func (it *mergeIterator) Key() []byte {
+	return it.key
+}
+
+func (it *mergeIterator) Valid() bool {
+	return it.key != nil && it.err == nil
+}
+
+func (it *mergeIterator) Error() error {
+	return it.err
+}
+
+func (it *mergeIterator) Release() {
+	it.entries = nil
+	it.key = nil
+}
+
+func (it *mergeIterator) advance() bool {
+	it.started = true
+	if it.entries == nil {
+		it.key = nil
+		return false
+	}
+
+	val, err := it.entries.popMerged()
+	if err == io.EOF {
+		it.key = nil
+		return false
+	}
+	if err != nil {
+		it.err = err
+		it.key = nil
+		return false
+	}
+
+	it.key = val
+	return true
+}
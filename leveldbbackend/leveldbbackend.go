@@ -0,0 +1,86 @@
+// Package leveldbbackend adapts a *leveldb.DB to the emsort.Sorter
+// interface, so callers who already have a LevelDB handle open can sort by
+// inserting keys into it instead of running a separate disk-based external
+// merge sort.
+package leveldbbackend
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+
+	"github.com/zer0main/emsort"
+)
+
+// Backend wraps a *leveldb.DB as an emsort.Sorter. Pushed records become
+// keys with an empty value, so LevelDB's own key ordering does the
+// sorting; Pop and the Iterator returned by NewIterator walk the DB in
+// that order.
+type Backend struct {
+	db   *leveldb.DB
+	iter iterator.Iterator
+}
+
+// New wraps db as an emsort.Sorter configured by opts, as when db is used
+// via SortOptions.Backend. It returns an error if opts asks for anything
+// Backend can't honor: LevelDB's key ordering is fixed by db's own,
+// already-open Comparer, not swappable per call, and Push stores each
+// record as a LevelDB key, so a record pushed more than once is stored
+// once: duplicates are always dropped, and nothing is left for Unique or
+// MergeFunc to act on. Only the zero value of Comparer, Unique and MergeFunc is
+// accepted; opts.RecordSize is ignored, since Backend never frames records
+// into blocks.
+func New(db *leveldb.DB, opts emsort.Options) (*Backend, error) {
+	if cmp := opts.Comparer; cmp != nil {
+		if _, ok := cmp.(emsort.BytesComparer); !ok {
+			return nil, fmt.Errorf("leveldbbackend: New does not support Comparer %s; it always sorts by db's own LevelDB comparer", cmp.Name())
+		}
+	}
+	if opts.Unique {
+		return nil, fmt.Errorf("leveldbbackend: New does not support Options.Unique")
+	}
+	if opts.MergeFunc != nil {
+		return nil, fmt.Errorf("leveldbbackend: New does not support Options.MergeFunc")
+	}
+	return &Backend{db: db}, nil
+}
+
+func (b *Backend) Push(key []byte) error {
+	return b.db.Put(key, nil, nil)
+}
+
+func (b *Backend) StopWriting() error {
+	b.iter = b.db.NewIterator(nil, nil)
+	return nil
+}
+
+func (b *Backend) Pop() ([]byte, error) {
+	if !b.iter.Next() {
+		return nil, io.EOF
+	}
+	return b.iter.Key(), nil
+}
+
+// NewIterator returns an emsort.Iterator over the DB's key range. It must
+// be called after StopWriting.
+func (b *Backend) NewIterator() emsort.Iterator {
+	return &dbIterator{iter: b.db.NewIterator(nil, nil)}
+}
+
+// dbIterator adapts goleveldb's iterator.Iterator to emsort.Iterator; the
+// method sets already match.
+type dbIterator struct {
+	iter iterator.Iterator
+}
+
+func (it *dbIterator) First() bool             { return it.iter.First() }
+func (it *dbIterator) Next() bool              { return it.iter.Next() }
+func (it *dbIterator) Seek(target []byte) bool { return it.iter.Seek(target) }
+func (it *dbIterator) Key() []byte             { return it.iter.Key() }
+func (it *dbIterator) Valid() bool             { return it.iter.Valid() }
+func (it *dbIterator) Error() error            { return it.iter.Error() }
+func (it *dbIterator) Release()                { it.iter.Release() }
+
+var _ emsort.Sorter = (*Backend)(nil)
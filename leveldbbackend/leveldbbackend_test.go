@@ -0,0 +1,140 @@
+package leveldbbackend
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/zer0main/emsort"
+)
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emsort-leveldbbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	b, err := New(db, emsort.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []string{"5", "3", "1", "4", "2"} {
+		if err := b.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		record, err := b.Pop()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(record))
+	}
+
+	want := []string{"1", "2", "3", "4", "5"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// TestNewRejectsUnsupportedOptions checks that New errors instead of
+// silently ignoring Options it can't honor: db's comparer can't be swapped
+// per call, and Push already collapses duplicate records, leaving nothing
+// for Unique or MergeFunc to act on.
+func TestNewRejectsUnsupportedOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emsort-leveldbbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type reverseComparer struct{ emsort.BytesComparer }
+	for _, opts := range []emsort.Options{
+		{Comparer: reverseComparer{}},
+		{Unique: true},
+		{MergeFunc: func(a, b []byte) []byte { return a }},
+	} {
+		if _, err := New(db, opts); err == nil {
+			t.Errorf("New(%+v) succeeded, want an error", opts)
+		}
+	}
+}
+
+func TestBackendIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emsort-leveldbbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	b, err := New(db, emsort.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []string{"5", "3", "1", "4", "2"} {
+		if err := b.Push([]byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := b.NewIterator()
+	defer it.Release()
+
+	if !it.Seek([]byte("3")) {
+		t.Fatal("expected Seek to find a record")
+	}
+	var got []string
+	for ; it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"3", "4", "5"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
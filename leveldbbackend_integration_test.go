@@ -0,0 +1,76 @@
+package emsort_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/zer0main/emsort"
+	"github.com/zer0main/emsort/leveldbbackend"
+)
+
+// TestHashSortingLevel exercises emsort/leveldbbackend the same way
+// TestHashSorting and TestHashSortingFixed exercise ExternalSorter: sort
+// the sha256 of "0".."4999999" and check the hash of the concatenated,
+// sorted result. It lives in an external test package, rather than next to
+// those, because leveldbbackend imports emsort and an internal test file
+// importing leveldbbackend back would be a cycle.
+func TestHashSortingLevel(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "emsort-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, err := leveldbbackend.New(db, emsort.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Control for this value is in file control.py
+	want := "faa9d89248e26e9a6441ad4b1ac0543175ee33d20925b861623d0436a5633dbf"
+
+	for i := 0; i < 5000000; i++ {
+		text := strconv.Itoa(i)
+		hash := sha256.Sum256([]byte(text))
+		if err := s.Push(hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	hasher := sha256.New()
+	for {
+		record, err := s.Pop()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hasher.Write(record); err != nil {
+			panic(err)
+		}
+	}
+	sum := hasher.Sum(nil)
+
+	got := hex.EncodeToString(sum)
+	if got != want {
+		t.Errorf("Got %s, want %s.", got, want)
+	}
+}
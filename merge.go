@@ -0,0 +1,92 @@
+package emsort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Merge performs a k-way merge of inputs, each of which must already be
+// sorted according to opts' Comparer and framed the same way
+// ExternalSorter writes its runs: a Comparer-name header (see
+// writeRunHeader) followed by a sequence of blocks, optionally compressed
+// per opts' Compression, containing either varint-length-prefixed records
+// or, if opts.RecordSize is set, fixed-size records. The merged result is
+// written to out in the same framing, so it can in turn be used as an
+// input to a later Merge.
+//
+// This is useful for combining sorted shards produced independently, e.g.
+// on a cluster, without re-sorting them.
+func Merge(inputs []io.Reader, out io.Writer, opts Options) error {
+	it, err := NewMergeIterator(inputs, opts)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	if _, err := writeRunHeader(out, opts.comparer().Name()); err != nil {
+		return err
+	}
+
+	block := newBlockWriter(out, opts.compression())
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+	for it.First(); it.Valid(); it.Next() {
+		val := it.Key()
+		if opts.RecordSize == 0 {
+			n := binary.PutUvarint(sizeBuf, uint64(len(val)))
+			if _, err := block.Write(sizeBuf[:n]); err != nil {
+				return err
+			}
+		}
+		if _, err := block.Write(val); err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return block.Flush()
+}
+
+// NewMergeIterator returns an Iterator performing a k-way merge over
+// inputs, reusing the same entry/entryHeap machinery ExternalSorter uses to
+// merge its own runs. See Merge for the expected framing of inputs.
+func NewMergeIterator(inputs []io.Reader, opts Options) (Iterator, error) {
+	cmp := opts.comparer()
+	compression := opts.compression()
+
+	entries := &entryHeap{
+		cmp:       cmp,
+		unique:    opts.Unique,
+		mergeFunc: opts.MergeFunc,
+		entries:   make([]*entry, 0, len(inputs)),
+	}
+	for i, input := range inputs {
+		header := bufio.NewReader(input)
+		name, err := readRunHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if name != cmp.Name() {
+			return nil, fmt.Errorf("emsort: merge input %d was written with comparer %q, but Options specify comparer %q", i, name, cmp.Name())
+		}
+
+		e := &entry{
+			file:       bufio.NewReader(newBlockReader(header, compression)),
+			recordSize: opts.RecordSize,
+		}
+		has, err := e.Read()
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			entries.entries = append(entries.entries, e)
+		}
+	}
+	heap.Init(entries)
+
+	return &mergeIterator{cmp: cmp, entries: entries}, nil
+}
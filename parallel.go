@@ -0,0 +1,167 @@
+package emsort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// rotate hands the active buffer off to a background goroutine that sorts
+// and flushes it to disk, and installs a fresh buffer so Push can keep
+// going while that happens. At most one flush runs at a time: if the new
+// buffer fills before the previous flush finished, rotate waits for it so
+// memory use stays bounded to two buffers.
+func (s *ExternalSorter) rotate() error {
+	s.flushWG.Wait()
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+
+	vals := s.vals
+	s.vals = nil
+	s.memUsed = 0
+
+	s.flushWG.Add(1)
+	go func() {
+		defer s.flushWG.Done()
+		if err := s.flushSorted(vals); err != nil {
+			s.flushErr = err
+		}
+	}()
+
+	return nil
+}
+
+// flushSorted sorts vals in parallel and writes them to s.tmpfile as a new
+// run, recording its size in s.sizes.
+func (s *ExternalSorter) flushSorted(vals [][]byte) error {
+	chunks := s.sortChunks(vals)
+
+	out := bufio.NewWriterSize(s.tmpfile, writeBufferSize)
+	headerSize, err := writeRunHeader(out, s.cmp.Name())
+	if err != nil {
+		return err
+	}
+	size, err := s.writeSortedChunks(chunks, out)
+	if err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	s.sizes = append(s.sizes, headerSize+size)
+	return nil
+}
+
+// sortChunks partitions vals into up to GOMAXPROCS chunks and sorts each in
+// its own goroutine using s.cmp, returning the non-empty sorted chunks.
+func (s *ExternalSorter) sortChunks(vals [][]byte) [][][]byte {
+	n := runtime.GOMAXPROCS(0)
+	if n > len(vals) {
+		n = len(vals)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	chunkSize := (len(vals) + n - 1) / n
+	chunks := make([][][]byte, 0, n)
+	var wg sync.WaitGroup
+	for start := 0; start < len(vals); start += chunkSize {
+		end := start + chunkSize
+		if end > len(vals) {
+			end = len(vals)
+		}
+		chunk := vals[start:end]
+		chunks = append(chunks, chunk)
+
+		wg.Add(1)
+		go func(chunk [][]byte) {
+			defer wg.Done()
+			sort.Sort(&inmemory{chunk, s.cmp})
+		}(chunk)
+	}
+	wg.Wait()
+
+	return chunks
+}
+
+// chunkCursor tracks the next unread value of a sorted chunk being merged.
+type chunkCursor struct {
+	vals [][]byte
+	pos  int
+}
+
+// chunkHeap is a min-heap of chunkCursors, used to merge the sorted chunks
+// produced by sortChunks while streaming them to disk. It plays the same
+// role for in-memory chunks that entryHeap plays for on-disk runs.
+type chunkHeap struct {
+	cmp     Comparer
+	cursors []*chunkCursor
+}
+
+func (h *chunkHeap) Len() int { return len(h.cursors) }
+
+func (h *chunkHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	return h.cmp.Compare(a.vals[a.pos], b.vals[b.pos]) == -1
+}
+
+func (h *chunkHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+}
+
+func (h *chunkHeap) Push(x interface{}) {
+	h.cursors = append(h.cursors, x.(*chunkCursor))
+}
+
+func (h *chunkHeap) Pop() interface{} {
+	n := len(h.cursors)
+	x := h.cursors[n-1]
+	h.cursors = h.cursors[:n-1]
+	return x
+}
+
+// writeSortedChunks k-way merges the sorted chunks and writes the result to
+// out as a sequence of blocks, returning the number of bytes written.
+func (s *ExternalSorter) writeSortedChunks(chunks [][][]byte, out io.Writer) (int, error) {
+	block := newBlockWriter(out, s.compression)
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+
+	h := &chunkHeap{cmp: s.cmp, cursors: make([]*chunkCursor, 0, len(chunks))}
+	for _, chunk := range chunks {
+		h.cursors = append(h.cursors, &chunkCursor{vals: chunk})
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		c := h.cursors[0]
+		val := c.vals[c.pos]
+		if s.recordSize == 0 {
+			n := binary.PutUvarint(sizeBuf, uint64(len(val)))
+			if _, err := block.Write(sizeBuf[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := block.Write(val); err != nil {
+			return 0, err
+		}
+
+		c.pos++
+		if c.pos == len(c.vals) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+
+	if err := block.Flush(); err != nil {
+		return 0, err
+	}
+	return block.written, nil
+}
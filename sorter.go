@@ -0,0 +1,82 @@
+package emsort
+
+import "io"
+
+// Sorter is the interface implemented by ExternalSorter and by alternative
+// backends, such as emsort/leveldbbackend, so callers can swap the sorting
+// strategy behind a record source without changing call sites.
+type Sorter interface {
+	Push(b []byte) error
+	StopWriting() error
+	Pop() ([]byte, error)
+	NewIterator() Iterator
+}
+
+// SortOptions configures Sort.
+type SortOptions struct {
+	Options
+
+	// MemLimit bounds how much memory the default, disk-backed
+	// ExternalSorter may use before spilling a run to tmpfile. It is
+	// ignored if Backend is used.
+	MemLimit int
+
+	// ExpectedSize estimates the total number of bytes Sort will be asked
+	// to push. It is only consulted when Backend is set.
+	ExpectedSize int
+
+	// Backend, if set, constructs an alternative Sorter to use instead of
+	// a disk-backed ExternalSorter, provided ExpectedSize is positive and
+	// fits within MemLimit. emsort/leveldbbackend is the first such backend;
+	// it lives in its own package specifically so this package need not
+	// depend on goleveldb. If Backend is nil, or ExpectedSize is zero or
+	// exceeds MemLimit, Sort falls back to ExternalSorter, which scales to
+	// arbitrarily large inputs by spilling to tmpfile.
+	Backend func(opts Options) (Sorter, error)
+}
+
+// Sort drives a Sorter picked per opts over the records yielded by next,
+// then calls emit with each record of the sorted result in order. Sort
+// treats next returning io.EOF as the normal end of input; any other error
+// from next, and any error from emit, stops Sort and is returned as is.
+func Sort(tmpfile File, opts SortOptions, next func() ([]byte, error), emit func([]byte) error) error {
+	s, err := newSorter(tmpfile, opts)
+	if err != nil {
+		return err
+	}
+
+	for {
+		b, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := s.Push(b); err != nil {
+			return err
+		}
+	}
+
+	if err := s.StopWriting(); err != nil {
+		return err
+	}
+
+	for {
+		b, err := s.Pop()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := emit(b); err != nil {
+			return err
+		}
+	}
+}
+
+func newSorter(tmpfile File, opts SortOptions) (Sorter, error) {
+	if opts.Backend != nil && opts.ExpectedSize > 0 && opts.ExpectedSize <= opts.MemLimit {
+		return opts.Backend(opts.Options)
+	}
+	return New(opts.MemLimit, tmpfile, opts.Options)
+}